@@ -0,0 +1,174 @@
+// Copyright 2021 Grabtaxi Holdings Pte Ltd (GRAB), All rights reserved.
+
+// Use of this source code is governed by an MIT-style license that can be found in the LICENSE file
+
+package gosm
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionType identifies which Blob payload oneof field a PrimitiveBlock
+// is encoded into.
+type CompressionType string
+
+const (
+	// CompressionNone stores blocks uncompressed in Blob.Raw.
+	CompressionNone CompressionType = "none"
+	// CompressionZlib is the default, matching the reference osmium/osmosis writers.
+	CompressionZlib CompressionType = "zlib"
+	// CompressionZstd stores blocks in Blob.ZstdData.
+	CompressionZstd CompressionType = "zstd"
+	// CompressionLZ4 is reserved for a future built-in; register a Compressor
+	// under it with RegisterCompressor to use it today.
+	CompressionLZ4 CompressionType = "lz4"
+)
+
+// Compressor compresses a single marshalled PrimitiveBlock before it is
+// written into a Blob. Implementations must be safe for concurrent use, since
+// the compression worker pool calls Compress from multiple goroutines.
+type Compressor interface {
+	Compress([]byte) ([]byte, error)
+	Name() string
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[CompressionType]Compressor{
+		CompressionZlib: zlibCompressor{level: zlib.DefaultCompression},
+		CompressionZstd: zstdCompressor{level: zstd.SpeedDefault},
+	}
+
+	decompressorsMu sync.RWMutex
+	decompressors   = map[CompressionType]func([]byte) ([]byte, error){
+		CompressionZlib: decompressZlib,
+		CompressionZstd: decompressZstd,
+	}
+)
+
+// RegisterCompressor makes a Compressor available to WithCompression under t,
+// overriding any built-in registered under the same type. It is intended for
+// CompressionLZ4 and other custom codecs.
+func RegisterCompressor(t CompressionType, c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[t] = c
+}
+
+// RegisterDecompressor makes fn available to Decoder for payloads stored
+// under compression type t, overriding any built-in registered under the
+// same type. It is the read-side counterpart of RegisterCompressor.
+func RegisterDecompressor(t CompressionType, fn func([]byte) ([]byte, error)) {
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	decompressors[t] = fn
+}
+
+// lookupCompressor resolves t to a Compressor, applying level where the
+// built-in codec supports one.
+func lookupCompressor(t CompressionType, level int) (Compressor, error) {
+	compressorsMu.RLock()
+	c, ok := compressors[t]
+	compressorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("gosm: no compressor registered for compression type %q", t)
+	}
+
+	switch c.(type) {
+	case zlibCompressor:
+		return zlibCompressor{level: level}, nil
+	case zstdCompressor:
+		return zstdCompressor{level: zstdLevel(level)}, nil
+	default:
+		return c, nil
+	}
+}
+
+// decompressPayload inflates p using the decompression func registered for t.
+func decompressPayload(t CompressionType, p []byte) ([]byte, error) {
+	decompressorsMu.RLock()
+	fn, ok := decompressors[t]
+	decompressorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("gosm: no decompressor registered for compression type %q", t)
+	}
+	return fn(p)
+}
+
+type zlibCompressor struct {
+	level int
+}
+
+func (z zlibCompressor) Name() string { return string(CompressionZlib) }
+
+func (z zlibCompressor) Compress(p []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := zlib.NewWriterLevel(&b, z.level)
+	if err != nil {
+		return nil, fmt.Errorf("open zlib writer: %w", err)
+	}
+	if _, err := w.Write(p); err != nil {
+		return nil, fmt.Errorf("write zlib data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("close zlib writer: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+func decompressZlib(p []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, fmt.Errorf("open zlib reader: %w", err)
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type zstdCompressor struct {
+	level zstd.EncoderLevel
+}
+
+func (z zstdCompressor) Name() string { return string(CompressionZstd) }
+
+func (z zstdCompressor) Compress(p []byte) ([]byte, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(z.level))
+	if err != nil {
+		return nil, fmt.Errorf("open zstd writer: %w", err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll(p, nil), nil
+}
+
+func decompressZstd(p []byte) ([]byte, error) {
+	r, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, fmt.Errorf("open zstd reader: %w", err)
+	}
+	defer r.Close()
+	return r.DecodeAll(p, nil)
+}
+
+func zstdLevel(level int) zstd.EncoderLevel {
+	if level <= 0 {
+		return zstd.SpeedDefault
+	}
+	return zstd.EncoderLevel(level)
+}
+
+// WithCompression selects the codec used to compress each PrimitiveBlock.
+// level is codec-specific (e.g. 1-9 for zlib, matching compress/zlib; one of
+// the zstd.EncoderLevel speed presets for zstd) and ignored for
+// CompressionNone. It defaults to CompressionZlib at its default level.
+func WithCompression(t CompressionType, level int) Option {
+	return func(e *Encoder) {
+		e.compression = t
+		e.compressionLevel = level
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2021 Grabtaxi Holdings Pte Ltd (GRAB), All rights reserved.
+
+// Use of this source code is governed by an MIT-style license that can be found in the LICENSE file
+
+package gosm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/MichielMortier/gosm/gosmpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// Decoder reads the blob framing produced by Encoder and delivers the decoded
+// nodes, ways and relations it contains on typed channels.
+type Decoder struct {
+	reader io.Reader
+
+	allowedFeatures map[string]struct{}
+	bbox            *gosmpb.HeaderBBox
+
+	decodeWorkers int
+
+	Nodes     chan []*gosmpb.Node
+	Ways      chan []*gosmpb.Way
+	Relations chan []*gosmpb.Relation
+
+	errs chan error
+
+	logger logger
+}
+
+// NewDecoderRequiredInput contains the required parameters to initialize a decoder.
+type NewDecoderRequiredInput struct {
+	// Reader is the source of the pbf file, as written by Encoder.
+	Reader io.Reader
+	// AllowedFeatures is the allowlist the HeaderBlock's RequiredFeatures are checked against.
+	AllowedFeatures []string
+}
+
+// DecoderOption configures a Decoder at construction time.
+type DecoderOption func(*Decoder)
+
+// WithDecodeWorkers sets the number of goroutines used to inflate and unpack
+// data blobs concurrently. In-file order is still preserved at the Nodes/Ways/
+// Relations channel boundary. Defaults to 1 (fully sequential) when unset.
+func WithDecodeWorkers(n int) DecoderOption {
+	return func(d *Decoder) {
+		if n > 0 {
+			d.decodeWorkers = n
+		}
+	}
+}
+
+// NewDecoder initializes an OSM pbf decoder.
+func NewDecoder(input *NewDecoderRequiredInput, opts ...DecoderOption) *Decoder {
+	decoder := &Decoder{
+		reader:        input.Reader,
+		decodeWorkers: 1,
+
+		Nodes:     make(chan []*gosmpb.Node),
+		Ways:      make(chan []*gosmpb.Way),
+		Relations: make(chan []*gosmpb.Relation),
+		errs:      make(chan error),
+	}
+
+	if len(input.AllowedFeatures) > 0 {
+		decoder.allowedFeatures = make(map[string]struct{}, len(input.AllowedFeatures))
+		for _, f := range input.AllowedFeatures {
+			decoder.allowedFeatures[f] = struct{}{}
+		}
+	}
+
+	for _, opt := range opts {
+		opt(decoder)
+	}
+
+	if decoder.logger == nil {
+		decoder.logger = log.New(os.Stderr, logTag, log.LstdFlags)
+	}
+
+	return decoder
+}
+
+// BBox returns the bbox advertised by the file's HeaderBlock, or nil if the
+// writer did not set one.
+func (d *Decoder) BBox() *gosmpb.HeaderBBox {
+	return d.bbox
+}
+
+type decodeJob struct {
+	blob   *gosmpb.Blob
+	result chan decodeResult
+}
+
+type decodeResult struct {
+	nodes     []*gosmpb.Node
+	ways      []*gosmpb.Way
+	relations []*gosmpb.Relation
+	err       error
+}
+
+// Start reads and validates the file header synchronously, then begins
+// streaming data blobs on background goroutines. Nodes, Ways and Relations
+// must be drained by the caller until they are closed, after which the
+// returned error channel is also closed.
+func (d *Decoder) Start() (chan error, error) {
+	if err := d.readAndValidateHeader(); err != nil {
+		return nil, err
+	}
+
+	jobs := make(chan *decodeJob, d.decodeWorkers)
+	order := make(chan *decodeJob, 1024)
+
+	var workers sync.WaitGroup
+	workers.Add(d.decodeWorkers)
+	for i := 0; i < d.decodeWorkers; i++ {
+		go d.decodeWorker(jobs, &workers)
+	}
+
+	go d.readLoop(jobs, order)
+	go d.emitInOrder(order)
+
+	return d.errs, nil
+}
+
+// readLoop sequentially reads every remaining data blob from the underlying
+// reader (blob framing must be parsed in order since io.Reader has no
+// concept of seeking) and hands the raw Blob off to the worker pool for the
+// CPU-heavy decompress/unmarshal work.
+func (d *Decoder) readLoop(jobs chan<- *decodeJob, order chan<- *decodeJob) {
+	defer close(jobs)
+	defer close(order)
+
+	for {
+		blobType, blob, err := d.readBlob()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			d.errs <- fmt.Errorf("read blob: %w", err)
+			return
+		}
+		if blobType != blobTypeData {
+			// Unknown or auxiliary blob types (e.g. an index/TOC trailer) are
+			// ignored so older readers stay compatible with newer writers.
+			continue
+		}
+
+		job := &decodeJob{blob: blob, result: make(chan decodeResult, 1)}
+		jobs <- job
+		order <- job
+	}
+}
+
+func (d *Decoder) decodeWorker(jobs <-chan *decodeJob, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for job := range jobs {
+		nodes, ways, relations, err := d.decodeDataBlob(job.blob)
+		job.result <- decodeResult{nodes: nodes, ways: ways, relations: relations, err: err}
+	}
+}
+
+// emitInOrder waits on each job's result in enqueue order so that, even
+// though decoding happens concurrently, the Nodes/Ways/Relations channels
+// still observe the blobs in their original file order.
+func (d *Decoder) emitInOrder(order <-chan *decodeJob) {
+	defer close(d.Nodes)
+	defer close(d.Ways)
+	defer close(d.Relations)
+	defer close(d.errs)
+
+	for job := range order {
+		res := <-job.result
+		if res.err != nil {
+			d.errs <- res.err
+			continue
+		}
+		if len(res.nodes) > 0 {
+			d.Nodes <- res.nodes
+		}
+		if len(res.ways) > 0 {
+			d.Ways <- res.ways
+		}
+		if len(res.relations) > 0 {
+			d.Relations <- res.relations
+		}
+	}
+}
+
+func (d *Decoder) validateRequiredFeatures(required []string) error {
+	if d.allowedFeatures == nil {
+		return nil
+	}
+	for _, f := range required {
+		if _, ok := d.allowedFeatures[f]; !ok {
+			return fmt.Errorf("required feature %q is not in the allowed feature list", f)
+		}
+	}
+	return nil
+}
+
+// readBlob reads one length-prefixed BlobHeader followed by its Blob from
+// the underlying reader, mirroring the framing encodeBlockToBlob writes.
+func (d *Decoder) readBlob() (string, *gosmpb.Blob, error) {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(d.reader, lenBuf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return "", nil, io.EOF
+		}
+		return "", nil, err
+	}
+	blobHeaderSize := binary.BigEndian.Uint32(lenBuf)
+
+	blobHeaderBuf := make([]byte, blobHeaderSize)
+	if _, err := io.ReadFull(d.reader, blobHeaderBuf); err != nil {
+		return "", nil, fmt.Errorf("read blob header: %w", err)
+	}
+	blobHeader := &gosmpb.BlobHeader{}
+	if err := proto.Unmarshal(blobHeaderBuf, blobHeader); err != nil {
+		return "", nil, fmt.Errorf("unmarshal blob header: %w", err)
+	}
+
+	blobBuf := make([]byte, blobHeader.GetDatasize())
+	if _, err := io.ReadFull(d.reader, blobBuf); err != nil {
+		return "", nil, fmt.Errorf("read blob: %w", err)
+	}
+	blob := &gosmpb.Blob{}
+	if err := proto.Unmarshal(blobBuf, blob); err != nil {
+		return "", nil, fmt.Errorf("unmarshal blob: %w", err)
+	}
+
+	return blobHeader.GetType(), blob, nil
+}
+
+// decompressBlob inflates whichever payload oneof field the writer populated,
+// dispatching to the decompression func registered for that compression type.
+func decompressBlob(blob *gosmpb.Blob) ([]byte, error) {
+	switch {
+	case blob.Raw != nil:
+		return blob.Raw, nil
+	case blob.ZlibData != nil:
+		return decompressPayload(CompressionZlib, blob.ZlibData)
+	case blob.ZstdData != nil:
+		return decompressPayload(CompressionZstd, blob.ZstdData)
+	case blob.Lz4Data != nil:
+		return decompressPayload(CompressionLZ4, blob.Lz4Data)
+	default:
+		return nil, fmt.Errorf("unsupported blob compression: no known payload field set")
+	}
+}
+
+func (d *Decoder) decodeDataBlob(blob *gosmpb.Blob) ([]*gosmpb.Node, []*gosmpb.Way, []*gosmpb.Relation, error) {
+	block, err := unmarshalDataBlob(blob)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return extractMembers(block)
+}
+
+// unmarshalDataBlob decompresses and unmarshals blob into its PrimitiveBlock,
+// without extracting members. Used where the block itself is needed, e.g. to
+// compute index stats for a linear-scan seek fallback.
+func unmarshalDataBlob(blob *gosmpb.Blob) (*gosmpb.PrimitiveBlock, error) {
+	payload, err := decompressBlob(blob)
+	if err != nil {
+		return nil, fmt.Errorf("decompress data blob: %w", err)
+	}
+	block := &gosmpb.PrimitiveBlock{}
+	if err := proto.Unmarshal(payload, block); err != nil {
+		return nil, fmt.Errorf("unmarshal primitive block: %w", err)
+	}
+	return block, nil
+}
+
+// extractMembers flattens a PrimitiveBlock's groups into its nodes, ways and
+// relations, expanding any DenseNodes group along the way.
+func extractMembers(block *gosmpb.PrimitiveBlock) ([]*gosmpb.Node, []*gosmpb.Way, []*gosmpb.Relation, error) {
+	var nodes []*gosmpb.Node
+	var ways []*gosmpb.Way
+	var relations []*gosmpb.Relation
+	for _, group := range block.Primitivegroup {
+		nodes = append(nodes, group.Nodes...)
+		if group.Dense != nil {
+			dense, err := expandDenseNodes(group.Dense)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			nodes = append(nodes, dense...)
+		}
+		ways = append(ways, group.Ways...)
+		relations = append(relations, group.Relations...)
+	}
+	return nodes, ways, relations, nil
+}
+
+// expandDenseNodes un-delta-codes a DenseNodes group into individual Node
+// messages so that callers only ever need to deal with one node shape. It
+// returns an error rather than panicking if KeysVals is malformed, since it
+// may come straight from an untrusted file.
+func expandDenseNodes(dense *gosmpb.DenseNodes) ([]*gosmpb.Node, error) {
+	nodes := make([]*gosmpb.Node, 0, len(dense.Id))
+
+	var id, lat, lon int64
+	kvIdx := 0
+	for i := range dense.Id {
+		id += dense.Id[i]
+		lat += dense.Lat[i]
+		lon += dense.Lon[i]
+
+		node := &gosmpb.Node{Id: id, Lat: lat, Lon: lon}
+		for kvIdx < len(dense.KeysVals) {
+			if dense.KeysVals[kvIdx] == 0 {
+				kvIdx++
+				break
+			}
+			if kvIdx+1 >= len(dense.KeysVals) {
+				return nil, fmt.Errorf("expand dense nodes: truncated keys_vals at index %d", kvIdx)
+			}
+			node.Keys = append(node.Keys, uint32(dense.KeysVals[kvIdx]))
+			node.Vals = append(node.Vals, uint32(dense.KeysVals[kvIdx+1]))
+			kvIdx += 2
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
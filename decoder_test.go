@@ -0,0 +1,28 @@
+// Copyright 2021 Grabtaxi Holdings Pte Ltd (GRAB), All rights reserved.
+
+// Use of this source code is governed by an MIT-style license that can be found in the LICENSE file
+
+package gosm
+
+import (
+	"testing"
+
+	"github.com/MichielMortier/gosm/gosmpb"
+)
+
+// TestExpandDenseNodesTruncatedKeysVals ensures a malformed DenseNodes group
+// whose KeysVals ends on an unpaired key (no matching value before the
+// array runs out) returns an error instead of panicking with an
+// index-out-of-range.
+func TestExpandDenseNodesTruncatedKeysVals(t *testing.T) {
+	dense := &gosmpb.DenseNodes{
+		Id:       []int64{1},
+		Lat:      []int64{1},
+		Lon:      []int64{1},
+		KeysVals: []int32{5},
+	}
+
+	if _, err := expandDenseNodes(dense); err == nil {
+		t.Fatal("expandDenseNodes with truncated KeysVals = nil error, want an error")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/MichielMortier/gosm/gosmpb"
 	"github.com/golang/protobuf/proto"
@@ -32,12 +33,35 @@ type Encoder struct {
 	requiredFeatures []string
 	optionalFeatures []string
 	writingProgram   string
-	enableZlip       bool
+
+	compression        CompressionType
+	compressionLevel   int
+	compressor         Compressor
+	compressionWorkers int
+	writeSeq           uint64
+
+	indexEnabled bool
+	indexEntries []*gosmpb.IndexEntry
+	writeOffset  uint64
+
+	headerMode            headerMode
+	headerPlaceholderSize int
+	headerFrameLen        int
+	deferredBuf           *bytes.Buffer
+
+	headerStatsMu     sync.Mutex
+	haveHeaderCoord   bool
+	minHeaderLat      int64
+	maxHeaderLat      int64
+	minHeaderLon      int64
+	maxHeaderLon      int64
+	sawDenseNodes     bool
+	sawHistoricalInfo bool
 
 	writer io.WriteCloser
 
 	errs          chan error
-	writeBuf      chan *gosmpb.PrimitiveBlock
+	writeBuf      chan *writeJob
 	nodesBuf      chan members
 	waysBuf       chan members
 	relationsBuf  chan members
@@ -70,7 +94,7 @@ func NewEncoder(input *NewEncoderRequiredInput, opts ...Option) *Encoder {
 		requiredFeatures: input.RequiredFeatures,
 		writer:           input.Writer,
 
-		writeBuf:      make(chan *gosmpb.PrimitiveBlock),
+		writeBuf:      make(chan *writeJob),
 		errs:          make(chan error),
 		nodesBuf:      make(chan members),
 		waysBuf:       make(chan members),
@@ -80,7 +104,10 @@ func NewEncoder(input *NewEncoderRequiredInput, opts ...Option) *Encoder {
 		relationFlush: make(chan chan struct{}),
 	}
 
-	encoder.enableZlip = true
+	encoder.compression = CompressionZlib
+	encoder.compressionLevel = zlib.DefaultCompression
+	encoder.compressionWorkers = 1
+	encoder.headerPlaceholderSize = defaultHeaderPlaceholderSize
 	for _, opt := range opts {
 		opt(encoder)
 	}
@@ -103,7 +130,14 @@ func (e *Encoder) processMembers(membersBufChan chan members, flushChan chan cha
 				e.errs <- fmt.Errorf("flush %s: %w", memberType, err)
 				return
 			}
-			e.writeBuf <- pgs
+			if e.headerMode != headerModeImmediate {
+				if err := e.trackHeaderStats(pgs); err != nil {
+					e.errs <- fmt.Errorf("flush %s: %w", memberType, err)
+					return
+				}
+			}
+			seq := atomic.AddUint64(&e.writeSeq, 1) - 1
+			e.writeBuf <- &writeJob{seq: seq, block: pgs}
 			appendedMembers.clear()
 		}
 	}
@@ -138,48 +172,28 @@ func (e *Encoder) processMembers(membersBufChan chan members, flushChan chan cha
 
 // Start will write the header file to the writer and start consuming data channel and write to the writer.
 func (e *Encoder) Start() (chan error, error) {
-	e.errWg.Add(1)
-	go func() {
-		for {
-			d, ok := <-e.writeBuf
-			if !ok {
-				// no err data to write, can close err chan now
-				e.errWg.Done()
-				return
-			}
-			encodedBlob, err := proto.Marshal(d)
-			if err != nil {
-				e.errs <- fmt.Errorf("marshal blob data: %w", err)
-			}
-			if err := e.encodeBlockToBlob(encodedBlob, blobTypeData); err != nil {
-				e.errs <- fmt.Errorf("encode data block :%w", err)
-			}
+	if e.compression != CompressionNone {
+		compressor, err := lookupCompressor(e.compression, e.compressionLevel)
+		if err != nil {
+			return nil, fmt.Errorf("resolve compressor: %w", err)
 		}
-	}()
+		e.compressor = compressor
+	}
+
+	if e.headerMode != headerModeImmediate {
+		e.deferredBuf = &bytes.Buffer{}
+	}
+
+	if err := e.startHeader(); err != nil {
+		return nil, err
+	}
+
+	e.startCompressionPipeline()
 	e.wg.Add(3)
 	go e.processMembers(e.nodesBuf, e.nodeFlush, "osm node")
 	go e.processMembers(e.waysBuf, e.wayFlush, "osm ways")
 	go e.processMembers(e.relationsBuf, e.relationFlush, "osm relations")
 
-	// write file header
-	header := &gosmpb.HeaderBlock{
-		Bbox:             e.bbox,
-		RequiredFeatures: e.requiredFeatures,
-		OptionalFeatures: e.optionalFeatures,
-	}
-	if e.writingProgram == "" {
-		header.Writingprogram = nil
-	} else {
-		header.Writingprogram = &e.writingProgram
-	}
-	encodedHeader, err := proto.Marshal(header)
-	if err != nil {
-		return nil, fmt.Errorf("marshal file header: %w", err)
-	}
-
-	if err := e.encodeBlockToBlob(encodedHeader, blobTypeHeader); err != nil {
-		return nil, fmt.Errorf("encode blob header: %w", err)
-	}
 	return e.errs, nil
 }
 
@@ -197,6 +211,31 @@ func (e *Encoder) Close() error {
 	e.wg.Wait()
 	close(e.writeBuf)
 	e.errWg.Wait()
+
+	var headerFrame []byte
+	if e.headerMode == headerModeDeferred {
+		hf, err := e.marshalAutoHeaderFrame()
+		if err != nil {
+			e.errs <- fmt.Errorf("finalize header: %w", err)
+		}
+		headerFrame = hf
+		// Entries recorded so far are offset relative to the start of the
+		// buffered body, since nothing has actually been written yet; shift
+		// them to absolute file offsets now that the real header's length is
+		// known, before they're serialized into the index blob below.
+		if e.indexEnabled {
+			e.rebaseIndexEntries(uint64(len(headerFrame)))
+		}
+	}
+
+	indexOffset, indexLen, haveIndex, err := e.writeIndexBlob()
+	if err != nil {
+		e.errs <- fmt.Errorf("write index blob: %w", err)
+	}
+	if err := e.finalizeHeader(headerFrame, indexOffset, indexLen, haveIndex); err != nil {
+		e.errs <- fmt.Errorf("finalize header: %w", err)
+	}
+
 	close(e.errs)
 	return e.writer.Close()
 }
@@ -228,24 +267,41 @@ func (e *Encoder) Flush(memberType MemberType) {
 // encodeBlockToBlob wraps the encoded data into blob and write blob header length, blob header and blob to writer
 // return n bytes written and error.
 func (e *Encoder) encodeBlockToBlob(p []byte, blobType string) error {
+	frame, err := e.buildBlobFrame(p, blobType)
+	if err != nil {
+		return err
+	}
+	return e.writeBlobFrame(frame)
+}
+
+// buildBlobFrame marshals and (optionally) compresses p into a Blob, wraps it
+// in a BlobHeader, and returns the length-prefixed bytes ready to be written
+// verbatim to the output. It touches no shared state besides e.compressor, so
+// it is safe to call concurrently from the compression worker pool.
+func (e *Encoder) buildBlobFrame(p []byte, blobType string) ([]byte, error) {
 	blob := &gosmpb.Blob{}
 	blob.RawSize = countInt32LenOfBytes(p)
-	if e.enableZlip {
-		var b bytes.Buffer
-		w := zlib.NewWriter(&b)
-		if _, err := w.Write(p); err != nil {
-			return fmt.Errorf("compress block: %w", err)
+	if e.compression == CompressionNone {
+		blob.Raw = p
+	} else {
+		compressed, err := e.compressor.Compress(p)
+		if err != nil {
+			return nil, fmt.Errorf("compress block: %w", err)
 		}
-		if err := w.Close(); err != nil {
-			return fmt.Errorf("close zlib writer: %w", err)
+		switch e.compression {
+		case CompressionZlib:
+			blob.ZlibData = compressed
+		case CompressionZstd:
+			blob.ZstdData = compressed
+		case CompressionLZ4:
+			blob.Lz4Data = compressed
+		default:
+			return nil, fmt.Errorf("encode blob: unsupported compression %q", e.compression)
 		}
-		blob.ZlibData = b.Bytes()
-	} else {
-		blob.Raw = p
 	}
 	encodedBlob, err := proto.Marshal(blob)
 	if err != nil {
-		return fmt.Errorf("marshal blob: %w", err)
+		return nil, fmt.Errorf("marshal blob: %w", err)
 	}
 
 	blobHeader := &gosmpb.BlobHeader{
@@ -254,20 +310,30 @@ func (e *Encoder) encodeBlockToBlob(p []byte, blobType string) error {
 	}
 	encodedBlobHeader, err := proto.Marshal(blobHeader)
 	if err != nil {
-		return fmt.Errorf("marshal blob header: %w", err)
+		return nil, fmt.Errorf("marshal blob header: %w", err)
 	}
 
 	blobHeaderSize := uint32(len(encodedBlobHeader))
-	headerLengthInNetworkByte := make([]byte, 4) // uint32 takes 4 bytes
-	binary.BigEndian.PutUint32(headerLengthInNetworkByte, blobHeaderSize)
-	if _, err = e.writer.Write(headerLengthInNetworkByte); err != nil {
-		return fmt.Errorf("write header length: %w", err)
-	}
-	if _, err = e.writer.Write(encodedBlobHeader); err != nil {
-		return fmt.Errorf("write blob header: %w", err)
+	frame := make([]byte, 4, 4+len(encodedBlobHeader)+len(encodedBlob))
+	binary.BigEndian.PutUint32(frame, blobHeaderSize)
+	frame = append(frame, encodedBlobHeader...)
+	frame = append(frame, encodedBlob...)
+	return frame, nil
+}
+
+// writeBlobFrame writes a frame built by buildBlobFrame to the output. Frames
+// must be written in sequence order, so callers on the compression worker
+// pool must route through the single writer goroutine started by
+// startCompressionPipeline rather than calling this directly.
+func (e *Encoder) writeBlobFrame(frame []byte) error {
+	if e.headerMode == headerModeDeferred {
+		e.deferredBuf.Write(frame)
+		e.writeOffset += uint64(len(frame))
+		return nil
 	}
-	if _, err = e.writer.Write(encodedBlob); err != nil {
-		return fmt.Errorf("write blob: %w", err)
+	if _, err := e.writer.Write(frame); err != nil {
+		return fmt.Errorf("write blob frame: %w", err)
 	}
+	e.writeOffset += uint64(len(frame))
 	return nil
 }
@@ -0,0 +1,413 @@
+// Copyright 2021 Grabtaxi Holdings Pte Ltd (GRAB), All rights reserved.
+
+// Use of this source code is governed by an MIT-style license that can be found in the LICENSE file
+
+package gosm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/MichielMortier/gosm/gosmpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// headerMode selects how Encoder.Start produces the file's HeaderBlock.
+type headerMode int
+
+const (
+	// headerModeImmediate writes the caller-supplied bbox/features as the
+	// very first blob, exactly as the original Encoder always did.
+	headerModeImmediate headerMode = iota
+	// headerModeDeferred buffers the entire body in memory and only writes
+	// the header, derived from the data actually seen, on Close.
+	headerModeDeferred
+	// headerModePlaceholder reserves a padded header blob up front so the
+	// file stays streamable, then rewrites it in place on Close via
+	// io.WriterAt.
+	headerModePlaceholder
+)
+
+const (
+	featureOsmSchemaV06   = "OsmSchema-V0.6"
+	featureDenseNodes     = "DenseNodes"
+	featureHistoricalInfo = "HistoricalInformation"
+
+	defaultHeaderPlaceholderSize = 4096
+)
+
+// WithDeferredHeader buffers the file header until Close(), tracking the
+// bbox of every node written and deriving RequiredFeatures ("DenseNodes",
+// "HistoricalInformation") from what was actually encoded, instead of
+// requiring the caller to pre-compute them. Because the header must be the
+// first blob in the file, this mode buffers the entire body in memory and
+// only writes it out on Close().
+func WithDeferredHeader() Option {
+	return func(e *Encoder) {
+		e.headerMode = headerModeDeferred
+	}
+}
+
+// WithHeaderPlaceholder reserves a fixed-size padded header blob up front,
+// computing the same automatic bbox/RequiredFeatures as WithDeferredHeader
+// but rewriting it in place on Close() so the body can still stream to the
+// writer as it's produced. This requires e's writer to also implement
+// io.WriterAt; when it doesn't, gosm logs a warning and falls back to
+// buffering the whole file like WithDeferredHeader.
+func WithHeaderPlaceholder() Option {
+	return func(e *Encoder) {
+		e.headerMode = headerModePlaceholder
+	}
+}
+
+// WithHeaderPlaceholderSize overrides the number of bytes WithHeaderPlaceholder
+// reserves for the header blob. Encoding a header that doesn't fit in this
+// many bytes once the final bbox/features are known is an error at Close().
+func WithHeaderPlaceholderSize(n int) Option {
+	return func(e *Encoder) {
+		if n > 0 {
+			e.headerPlaceholderSize = n
+		}
+	}
+}
+
+// startHeader writes (or reserves) the file's first blob according to
+// e.headerMode.
+func (e *Encoder) startHeader() error {
+	switch e.headerMode {
+	case headerModeDeferred:
+		return nil
+	case headerModePlaceholder:
+		if _, ok := e.writer.(io.WriterAt); !ok {
+			e.logger.Printf("%s: writer does not support WriteAt, falling back to buffering the whole file for WithHeaderPlaceholder", logTag)
+			e.headerMode = headerModeDeferred
+			return nil
+		}
+		return e.writeHeaderPlaceholder()
+	default:
+		return e.writeImmediateHeader()
+	}
+}
+
+func (e *Encoder) writeImmediateHeader() error {
+	header := &gosmpb.HeaderBlock{
+		Bbox:             e.bbox,
+		RequiredFeatures: e.requiredFeatures,
+		OptionalFeatures: e.optionalFeatures,
+	}
+	if e.writingProgram != "" {
+		header.Writingprogram = &e.writingProgram
+	}
+	encodedHeader, err := proto.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("marshal file header: %w", err)
+	}
+	if err := e.encodeBlockToBlob(encodedHeader, blobTypeHeader); err != nil {
+		return fmt.Errorf("encode blob header: %w", err)
+	}
+	return nil
+}
+
+// writeHeaderPlaceholder writes a padded, uncompressed header blob of
+// e.headerPlaceholderSize bytes so the real header can be rewritten in
+// place at the same offset on Close().
+func (e *Encoder) writeHeaderPlaceholder() error {
+	header := &gosmpb.HeaderBlock{
+		Bbox:             e.bbox,
+		RequiredFeatures: e.requiredFeatures,
+		OptionalFeatures: e.optionalFeatures,
+	}
+	encodedHeader, err := proto.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("marshal placeholder header: %w", err)
+	}
+	frame, err := e.buildPaddedRawBlobFrame(encodedHeader, blobTypeHeader, e.headerPlaceholderSize)
+	if err != nil {
+		return fmt.Errorf("build placeholder header: %w", err)
+	}
+	e.headerFrameLen = len(frame)
+	return e.writeBlobFrame(frame)
+}
+
+// finalizeHeader writes the real, automatically-derived header for
+// headerModeDeferred/headerModePlaceholder, and appends the index trailer
+// (at its final, correctly-offset position) when WithIndex is enabled. For
+// headerModeImmediate, whose header was already written by Start(), it only
+// writes that trailer (or nothing without WithIndex). headerFrame is the already-marshalled header for headerModeDeferred
+// (built by the caller before the index blob was serialized, so index entry
+// offsets could be rebased against its length); it is unused otherwise.
+func (e *Encoder) finalizeHeader(headerFrame []byte, indexOffset, indexLen uint64, haveIndex bool) error {
+	switch e.headerMode {
+	case headerModeDeferred:
+		if _, err := e.writer.Write(headerFrame); err != nil {
+			return fmt.Errorf("write file header: %w", err)
+		}
+		if _, err := e.writer.Write(e.deferredBuf.Bytes()); err != nil {
+			return fmt.Errorf("write buffered body: %w", err)
+		}
+		if haveIndex {
+			return e.writeIndexTrailer(indexOffset+uint64(len(headerFrame)), indexLen)
+		}
+		return nil
+	case headerModePlaceholder:
+		header := e.buildAutoHeader()
+		encodedHeader, err := proto.Marshal(header)
+		if err != nil {
+			return fmt.Errorf("marshal file header: %w", err)
+		}
+		frame, err := e.buildPaddedRawBlobFrame(encodedHeader, blobTypeHeader, e.headerFrameLen)
+		if err != nil {
+			return fmt.Errorf("rebuild header: %w", err)
+		}
+		if _, err := e.writer.(io.WriterAt).WriteAt(frame, 0); err != nil {
+			return fmt.Errorf("rewrite header placeholder: %w", err)
+		}
+		if haveIndex {
+			return e.writeIndexTrailer(indexOffset, indexLen)
+		}
+		return nil
+	default:
+		if haveIndex {
+			return e.writeIndexTrailer(indexOffset, indexLen)
+		}
+		return nil
+	}
+}
+
+func (e *Encoder) marshalAutoHeaderFrame() ([]byte, error) {
+	header := e.buildAutoHeader()
+	encodedHeader, err := proto.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("marshal file header: %w", err)
+	}
+	frame, err := e.buildBlobFrame(encodedHeader, blobTypeHeader)
+	if err != nil {
+		return nil, fmt.Errorf("encode blob header: %w", err)
+	}
+	return frame, nil
+}
+
+// trackHeaderStats folds a just-flushed PrimitiveBlock into the running bbox
+// and RequiredFeatures inference used by headerModeDeferred/
+// headerModePlaceholder. Called from multiple processMembers goroutines, so
+// it locks e.headerStatsMu.
+func (e *Encoder) trackHeaderStats(block *gosmpb.PrimitiveBlock) error {
+	granularity := int64(100)
+	if block.Granularity != nil {
+		granularity = int64(*block.Granularity)
+	}
+	var latOffset, lonOffset int64
+	if block.LatOffset != nil {
+		latOffset = *block.LatOffset
+	}
+	if block.LonOffset != nil {
+		lonOffset = *block.LonOffset
+	}
+
+	e.headerStatsMu.Lock()
+	defer e.headerStatsMu.Unlock()
+
+	noteCoord := func(lat, lon int64) {
+		if !e.haveHeaderCoord || lat < e.minHeaderLat {
+			e.minHeaderLat = lat
+		}
+		if !e.haveHeaderCoord || lat > e.maxHeaderLat {
+			e.maxHeaderLat = lat
+		}
+		if !e.haveHeaderCoord || lon < e.minHeaderLon {
+			e.minHeaderLon = lon
+		}
+		if !e.haveHeaderCoord || lon > e.maxHeaderLon {
+			e.maxHeaderLon = lon
+		}
+		e.haveHeaderCoord = true
+	}
+
+	for _, group := range block.Primitivegroup {
+		for _, n := range group.Nodes {
+			noteCoord(latOffset+granularity*n.Lat, lonOffset+granularity*n.Lon)
+			if n.Info != nil {
+				e.sawHistoricalInfo = true
+			}
+		}
+		if group.Dense != nil {
+			e.sawDenseNodes = true
+			if group.Dense.Denseinfo != nil {
+				e.sawHistoricalInfo = true
+			}
+			dense, err := expandDenseNodes(group.Dense)
+			if err != nil {
+				return err
+			}
+			for _, n := range dense {
+				noteCoord(latOffset+granularity*n.Lat, lonOffset+granularity*n.Lon)
+			}
+		}
+		for _, w := range group.Ways {
+			if w.Info != nil {
+				e.sawHistoricalInfo = true
+			}
+		}
+		for _, r := range group.Relations {
+			if r.Info != nil {
+				e.sawHistoricalInfo = true
+			}
+		}
+	}
+	return nil
+}
+
+// buildAutoHeader assembles the final HeaderBlock from the caller-supplied
+// fields plus whatever trackHeaderStats observed.
+func (e *Encoder) buildAutoHeader() *gosmpb.HeaderBlock {
+	e.headerStatsMu.Lock()
+	defer e.headerStatsMu.Unlock()
+
+	requiredFeatures := append([]string{featureOsmSchemaV06}, e.requiredFeatures...)
+	if e.sawDenseNodes {
+		requiredFeatures = append(requiredFeatures, featureDenseNodes)
+	}
+	if e.sawHistoricalInfo {
+		requiredFeatures = append(requiredFeatures, featureHistoricalInfo)
+	}
+
+	header := &gosmpb.HeaderBlock{
+		RequiredFeatures: requiredFeatures,
+		OptionalFeatures: e.optionalFeatures,
+	}
+	if e.haveHeaderCoord {
+		header.Bbox = &gosmpb.HeaderBBox{
+			Left:   int64Pointer(e.minHeaderLon),
+			Right:  int64Pointer(e.maxHeaderLon),
+			Top:    int64Pointer(e.maxHeaderLat),
+			Bottom: int64Pointer(e.minHeaderLat),
+		}
+	} else {
+		header.Bbox = e.bbox
+	}
+	if e.writingProgram != "" {
+		header.Writingprogram = &e.writingProgram
+	}
+	return header
+}
+
+// maxPadFrameAttempts bounds the fixed-point search in buildPaddedRawBlobFrame:
+// appending a padding field of length n to the payload doesn't grow the final
+// frame by exactly n, since it also changes the payload's own length, which
+// can itself ripple through the length-delimited varints that encode
+// Blob.Raw and Blob.RawSize. The padding target is nudged by the observed
+// over/undershoot and re-measured until it converges, which takes only a
+// handful of iterations in practice.
+const maxPadFrameAttempts = 16
+
+// buildPaddedRawBlobFrame builds an uncompressed blob frame for p, padded
+// with a syntactically valid but unused protobuf field (proto2 unmarshal
+// skips unrecognized fields rather than rejecting them) so the total frame
+// is exactly size bytes. Used to keep a rewritten header the same length as
+// the placeholder it replaces.
+func (e *Encoder) buildPaddedRawBlobFrame(p []byte, blobType string, size int) ([]byte, error) {
+	frame, err := rawBlobFrame(p, blobType)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) > size {
+		return nil, fmt.Errorf("header content (%d bytes) does not fit in %d reserved bytes", len(frame), size)
+	}
+	if len(frame) == size {
+		return frame, nil
+	}
+
+	padLen := size - len(frame)
+	for attempt := 0; attempt < maxPadFrameAttempts; attempt++ {
+		padding, err := buildPaddingField(padLen)
+		if err != nil {
+			// padLen itself has no exact field encoding (e.g. a tag/length
+			// prefix straddle); nudge by a byte and let the next
+			// measurement correct for it.
+			padLen++
+			continue
+		}
+		payload := append(append([]byte{}, p...), padding...)
+		frame, err = rawBlobFrame(payload, blobType)
+		if err != nil {
+			return nil, err
+		}
+		if len(frame) == size {
+			return frame, nil
+		}
+		padLen += size - len(frame)
+		if padLen < 0 {
+			return nil, fmt.Errorf("header content (%d bytes) does not fit in %d reserved bytes", len(p), size)
+		}
+	}
+	return nil, fmt.Errorf("could not pad header blob to exactly %d bytes", size)
+}
+
+func rawBlobFrame(p []byte, blobType string) ([]byte, error) {
+	blob := &gosmpb.Blob{Raw: p, RawSize: countInt32LenOfBytes(p)}
+	encodedBlob, err := proto.Marshal(blob)
+	if err != nil {
+		return nil, fmt.Errorf("marshal blob: %w", err)
+	}
+	blobHeader := &gosmpb.BlobHeader{
+		Type:     stringToPointer(blobType),
+		Datasize: countInt32LenOfBytes(encodedBlob),
+	}
+	encodedBlobHeader, err := proto.Marshal(blobHeader)
+	if err != nil {
+		return nil, fmt.Errorf("marshal blob header: %w", err)
+	}
+	frame := make([]byte, 4, 4+len(encodedBlobHeader)+len(encodedBlob))
+	binary.BigEndian.PutUint32(frame, uint32(len(encodedBlobHeader)))
+	frame = append(frame, encodedBlobHeader...)
+	frame = append(frame, encodedBlob...)
+	return frame, nil
+}
+
+// paddingFieldNumber is a high, unused protobuf field number: proto2
+// unmarshal preserves/skips fields it doesn't recognize rather than
+// rejecting them, so a length-delimited value under this field number is a
+// safe place to stash header padding bytes.
+const paddingFieldNumber = 15000
+
+// maxPaddingFieldAttempts bounds the search in buildPaddingField: the
+// varint length prefix only changes width a handful of times as valueLen is
+// nudged towards a fixed point, so a solution (or the conclusion that none
+// exists, e.g. n == 132) is known well before this many iterations.
+const maxPaddingFieldAttempts = 16
+
+// buildPaddingField returns a protobuf field encoding, including its tag and
+// length prefix, whose total size is exactly n bytes. Not every n is
+// reachable (the tag plus length-prefix overhead can straddle a varint width
+// boundary with no exact fit, e.g. n == 132 here), in which case it returns
+// an error rather than looping forever.
+func buildPaddingField(n int) ([]byte, error) {
+	tag := encodeVarint(uint64(paddingFieldNumber<<3 | 2))
+	valueLen := n - len(tag)
+	for attempt := 0; attempt < maxPaddingFieldAttempts; attempt++ {
+		if valueLen < 0 {
+			return nil, fmt.Errorf("cannot pad to exactly %d bytes", n)
+		}
+		lenPrefix := encodeVarint(uint64(valueLen))
+		total := len(tag) + len(lenPrefix) + valueLen
+		if total == n {
+			field := make([]byte, 0, n)
+			field = append(field, tag...)
+			field = append(field, lenPrefix...)
+			field = append(field, make([]byte, valueLen)...)
+			return field, nil
+		}
+		valueLen += n - total
+	}
+	return nil, fmt.Errorf("cannot pad to exactly %d bytes", n)
+}
+
+func encodeVarint(x uint64) []byte {
+	var buf []byte
+	for x >= 0x80 {
+		buf = append(buf, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(buf, byte(x))
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 Grabtaxi Holdings Pte Ltd (GRAB), All rights reserved.
+
+// Use of this source code is governed by an MIT-style license that can be found in the LICENSE file
+
+package gosm
+
+import (
+	"os"
+	"testing"
+
+	"github.com/MichielMortier/gosm/gosmpb"
+)
+
+// TestHeaderPlaceholderRoundTrip exercises WithHeaderPlaceholder end to end
+// against a real io.WriterAt (*os.File): the placeholder header is reserved
+// on Start(), data is written, and the real header is rewritten in place on
+// Close(), so the nodes written must still decode correctly afterwards.
+func TestHeaderPlaceholderRoundTrip(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "gosm-placeholder-*.pbf")
+	if err != nil {
+		t.Fatalf("create temp file: %v", err)
+	}
+	defer f.Close()
+
+	e := NewEncoder(&NewEncoderRequiredInput{Writer: f}, WithHeaderPlaceholder())
+	errs, err := e.Start()
+	if err != nil {
+		t.Fatalf("start encoder: %v", err)
+	}
+	if e.headerMode != headerModePlaceholder {
+		t.Fatalf("headerMode = %v, want headerModePlaceholder (writer should support io.WriterAt)", e.headerMode)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for err := range errs {
+			t.Errorf("encode: %v", err)
+		}
+	}()
+
+	block := &gosmpb.PrimitiveBlock{
+		Primitivegroup: []*gosmpb.PrimitiveGroup{{
+			Nodes: []*gosmpb.Node{{Id: 1, Lat: 10, Lon: 20}},
+		}},
+	}
+	e.writeBuf <- &writeJob{seq: 0, block: block}
+	if err := e.Close(); err != nil {
+		t.Fatalf("close encoder: %v", err)
+	}
+	<-done
+
+	r, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatalf("reopen file: %v", err)
+	}
+	defer r.Close()
+
+	d := NewDecoder(&NewDecoderRequiredInput{Reader: r})
+	derrs, err := d.Start()
+	if err != nil {
+		t.Fatalf("start decoder: %v", err)
+	}
+
+	var gotNodes []*gosmpb.Node
+	done2 := make(chan struct{})
+	go func() {
+		defer close(done2)
+		for err := range derrs {
+			t.Errorf("decode: %v", err)
+		}
+	}()
+	for nodes := range d.Nodes {
+		gotNodes = append(gotNodes, nodes...)
+	}
+	for range d.Ways {
+	}
+	for range d.Relations {
+	}
+	<-done2
+
+	if len(gotNodes) != 1 {
+		t.Fatalf("decoded %d nodes, want 1", len(gotNodes))
+	}
+	if got := gotNodes[0]; got.Id != 1 || got.Lat != 10 || got.Lon != 20 {
+		t.Fatalf("decoded node = %+v, want {Id:1 Lat:10 Lon:20}", got)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Grabtaxi Holdings Pte Ltd (GRAB), All rights reserved.
+
+// Use of this source code is governed by an MIT-style license that can be found in the LICENSE file
+
+package gosm
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/MichielMortier/gosm/gosmpb"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	blobTypeIndex        = "OSMIndex"
+	blobTypeIndexTrailer = "OSMIndexTrailer"
+)
+
+// indexTrailerSize is the fixed width of the trailer payload gosm wraps in a
+// blob and appends after the index blob when WithIndex is enabled: an 8-byte
+// offset and a 4-byte length, both big-endian, so a reader can seek to the
+// end of the file and find the TOC without scanning it.
+const indexTrailerSize = 12
+
+// indexTrailerFrameSize is the fixed length of the blob frame writeIndexTrailer
+// produces. It only depends on indexTrailerSize and blobTypeIndexTrailer, both
+// constants, so it's computed once and reused by loadIndex to seek straight to
+// the frame from the end of the file.
+var indexTrailerFrameSize = mustIndexTrailerFrameSize()
+
+func mustIndexTrailerFrameSize() int {
+	frame, err := rawBlobFrame(make([]byte, indexTrailerSize), blobTypeIndexTrailer)
+	if err != nil {
+		panic(fmt.Sprintf("gosm: compute index trailer frame size: %v", err))
+	}
+	return len(frame)
+}
+
+// WithIndex enables an opt-in table-of-contents blob. As each data blob is
+// written, its file offset, sizes, member ID ranges and bbox are recorded;
+// on Close() the table is serialized as a final "OSMIndex" blob followed by
+// a small "OSMIndexTrailer" blob that points at it, so a Decoder can jump
+// straight to the blobs overlapping a queried bbox or ID range instead of
+// scanning the whole file. The trailer is itself a normal blob frame (not raw
+// bytes), so readers that don't know about "OSMIndex"/"OSMIndexTrailer"
+// simply skip both and keep streaming, and the file stays readable by
+// vanilla PBF readers.
+func WithIndex() Option {
+	return func(e *Encoder) {
+		e.indexEnabled = true
+	}
+}
+
+// recordIndexEntry appends one data blob's stats to the in-progress table of
+// contents. Only ever called from the single writer goroutine in
+// startCompressionPipeline, so it needs no locking.
+func (e *Encoder) recordIndexEntry(offset uint64, compressedSize int, stats *gosmpb.IndexEntry) {
+	stats.Offset = int64Pointer(int64(offset))
+	stats.CompressedSize = int32Pointer(int32(compressedSize))
+	e.indexEntries = append(e.indexEntries, stats)
+}
+
+// rebaseIndexEntries adds delta to every recorded entry's offset. Entries are
+// recorded by recordIndexEntry relative to the start of the output as known
+// at write time; in headerModeDeferred that's the start of the buffered
+// body, not the file, so this shifts them to absolute file offsets once the
+// real header's length is known, before the table is serialized.
+func (e *Encoder) rebaseIndexEntries(delta uint64) {
+	for _, entry := range e.indexEntries {
+		entry.Offset = int64Pointer(entry.GetOffset() + int64(delta))
+	}
+}
+
+// writeIndexBlob serializes the accumulated table of contents as a final
+// "OSMIndex" blob. It returns that blob's offset and length rather than also
+// writing the trailer, since headerModeDeferred doesn't know the absolute
+// offset until the real header's size is known; writeIndexTrailer() is the
+// caller's job once it does. ok is false when WithIndex was not set.
+func (e *Encoder) writeIndexBlob() (offset, length uint64, ok bool, err error) {
+	if !e.indexEnabled {
+		return 0, 0, false, nil
+	}
+
+	offset = e.writeOffset
+	index := &gosmpb.OSMIndex{Entries: e.indexEntries}
+	encodedIndex, err := proto.Marshal(index)
+	if err != nil {
+		return 0, 0, true, fmt.Errorf("marshal index: %w", err)
+	}
+	if err := e.encodeBlockToBlob(encodedIndex, blobTypeIndex); err != nil {
+		return 0, 0, true, fmt.Errorf("encode index blob: %w", err)
+	}
+	return offset, e.writeOffset - offset, true, nil
+}
+
+// writeIndexTrailer appends a small "OSMIndexTrailer" blob pointing at the
+// index blob at the given absolute offset. Always written directly to
+// e.writer, even in headerModeDeferred, since it runs after the deferred body
+// has been flushed. The trailer payload is wrapped in a normal blob frame
+// (rather than written as raw bytes) so that a streaming Decoder.Start() can
+// parse and skip it like any other unrecognized blob type instead of
+// mis-framing the raw bytes that follow the index blob.
+func (e *Encoder) writeIndexTrailer(offset, length uint64) error {
+	payload := make([]byte, indexTrailerSize)
+	binary.BigEndian.PutUint64(payload[:8], offset)
+	binary.BigEndian.PutUint32(payload[8:], uint32(length))
+	frame, err := rawBlobFrame(payload, blobTypeIndexTrailer)
+	if err != nil {
+		return fmt.Errorf("build index trailer: %w", err)
+	}
+	if _, err := e.writer.Write(frame); err != nil {
+		return fmt.Errorf("write index trailer: %w", err)
+	}
+	e.writeOffset += uint64(len(frame))
+	return nil
+}
+
+// computeBlockStats scans a PrimitiveBlock for the ID ranges and bbox of its
+// members. The Encoder only calls it when WithIndex is enabled, since it has
+// to expand dense nodes to see their ids and coordinates; the Decoder's
+// linear-scan seek fallback calls it for every data blob it reads.
+func computeBlockStats(block *gosmpb.PrimitiveBlock) (*gosmpb.IndexEntry, error) {
+	entry := &gosmpb.IndexEntry{}
+
+	granularity := int64(100)
+	if block.Granularity != nil {
+		granularity = int64(*block.Granularity)
+	}
+	var latOffset, lonOffset int64
+	if block.LatOffset != nil {
+		latOffset = *block.LatOffset
+	}
+	if block.LonOffset != nil {
+		lonOffset = *block.LonOffset
+	}
+
+	var (
+		haveNode, haveWay, haveRelation, haveCoord bool
+		minNodeID, maxNodeID                       int64
+		minWayID, maxWayID                         int64
+		minRelationID, maxRelationID               int64
+		minLat, maxLat, minLon, maxLon             int64
+	)
+
+	noteNode := func(id, lat, lon int64) {
+		if !haveNode || id < minNodeID {
+			minNodeID = id
+		}
+		if !haveNode || id > maxNodeID {
+			maxNodeID = id
+		}
+		haveNode = true
+
+		if !haveCoord || lat < minLat {
+			minLat = lat
+		}
+		if !haveCoord || lat > maxLat {
+			maxLat = lat
+		}
+		if !haveCoord || lon < minLon {
+			minLon = lon
+		}
+		if !haveCoord || lon > maxLon {
+			maxLon = lon
+		}
+		haveCoord = true
+	}
+
+	for _, group := range block.Primitivegroup {
+		for _, n := range group.Nodes {
+			noteNode(n.Id, latOffset+granularity*n.Lat, lonOffset+granularity*n.Lon)
+		}
+		if group.Dense != nil {
+			dense, err := expandDenseNodes(group.Dense)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range dense {
+				noteNode(n.Id, latOffset+granularity*n.Lat, lonOffset+granularity*n.Lon)
+			}
+		}
+		for _, w := range group.Ways {
+			if !haveWay || w.Id < minWayID {
+				minWayID = w.Id
+			}
+			if !haveWay || w.Id > maxWayID {
+				maxWayID = w.Id
+			}
+			haveWay = true
+		}
+		for _, r := range group.Relations {
+			if !haveRelation || r.Id < minRelationID {
+				minRelationID = r.Id
+			}
+			if !haveRelation || r.Id > maxRelationID {
+				maxRelationID = r.Id
+			}
+			haveRelation = true
+		}
+	}
+
+	if haveNode {
+		entry.MinNodeId = int64Pointer(minNodeID)
+		entry.MaxNodeId = int64Pointer(maxNodeID)
+	}
+	if haveWay {
+		entry.MinWayId = int64Pointer(minWayID)
+		entry.MaxWayId = int64Pointer(maxWayID)
+	}
+	if haveRelation {
+		entry.MinRelationId = int64Pointer(minRelationID)
+		entry.MaxRelationId = int64Pointer(maxRelationID)
+	}
+	if haveCoord {
+		entry.Bbox = &gosmpb.HeaderBBox{
+			Left:   int64Pointer(minLon),
+			Right:  int64Pointer(maxLon),
+			Top:    int64Pointer(maxLat),
+			Bottom: int64Pointer(minLat),
+		}
+	}
+	return entry, nil
+}
+
+func int64Pointer(v int64) *int64 { return &v }
+func int32Pointer(v int32) *int32 { return &v }
@@ -0,0 +1,145 @@
+// Copyright 2021 Grabtaxi Holdings Pte Ltd (GRAB), All rights reserved.
+
+// Use of this source code is governed by an MIT-style license that can be found in the LICENSE file
+
+package gosm
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/MichielMortier/gosm/gosmpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// writeJob pairs a PrimitiveBlock with the monotonic sequence number it was
+// assigned when enqueued, so the compression worker pool can process blocks
+// out of order while the writer goroutine still emits them in order.
+type writeJob struct {
+	seq   uint64
+	block *gosmpb.PrimitiveBlock
+}
+
+// seqResult is a writeJob's finished frame, tagged with the sequence
+// number of the writeJob it came from. stats is only populated when
+// WithIndex is enabled.
+type seqResult struct {
+	seq   uint64
+	frame []byte
+	stats *gosmpb.IndexEntry
+	err   error
+}
+
+// WithCompressionWorkers sets the number of goroutines used to marshal and
+// compress PrimitiveBlocks concurrently. The blobs they produce are still
+// written to the underlying writer strictly in enqueue order. Defaults to 1
+// (fully sequential) when unset.
+func WithCompressionWorkers(n int) Option {
+	return func(e *Encoder) {
+		if n > 0 {
+			e.compressionWorkers = n
+		}
+	}
+}
+
+// startCompressionPipeline wires up the write path: a fixed-size worker pool
+// pulls blocks off e.writeBuf and marshals/compresses them concurrently, and
+// a single writer goroutine reorders their results by sequence number before
+// writing them to e.writer, so the resulting PBF stays spec-compliant
+// regardless of which worker finishes a given block first.
+func (e *Encoder) startCompressionPipeline() {
+	workers := e.compressionWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan *writeJob, workers)
+	results := make(chan seqResult, workers)
+
+	go func() {
+		defer close(jobs)
+		for wj := range e.writeBuf {
+			jobs <- wj
+		}
+	}()
+
+	var workerWg sync.WaitGroup
+	workerWg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer workerWg.Done()
+			for wj := range jobs {
+				frame, stats, err := e.buildDataBlobFrame(wj.block)
+				results <- seqResult{seq: wj.seq, frame: frame, stats: stats, err: err}
+			}
+		}()
+	}
+	go func() {
+		workerWg.Wait()
+		close(results)
+	}()
+
+	e.errWg.Add(1)
+	go func() {
+		defer e.errWg.Done()
+
+		// pending holds out-of-order results keyed by sequence number until
+		// the writer catches up to them.
+		pending := make(map[uint64]seqResult)
+		var nextSeq uint64
+
+		emit := func(res seqResult) {
+			if res.err != nil {
+				e.errs <- res.err
+				return
+			}
+			offset := e.writeOffset
+			if err := e.writeBlobFrame(res.frame); err != nil {
+				e.errs <- fmt.Errorf("write data block %d: %w", res.seq, err)
+				return
+			}
+			if e.indexEnabled {
+				e.recordIndexEntry(offset, len(res.frame), res.stats)
+			}
+		}
+
+		for res := range results {
+			if res.seq == nextSeq {
+				emit(res)
+				nextSeq++
+			} else {
+				pending[res.seq] = res
+			}
+
+			for r, ok := pending[nextSeq]; ok; r, ok = pending[nextSeq] {
+				delete(pending, nextSeq)
+				emit(r)
+				nextSeq++
+			}
+		}
+	}()
+}
+
+// buildDataBlobFrame marshals a PrimitiveBlock and builds its blob frame,
+// along with its index stats when WithIndex is enabled. It has no side
+// effects on shared state, so compression workers may call it concurrently.
+func (e *Encoder) buildDataBlobFrame(block *gosmpb.PrimitiveBlock) ([]byte, *gosmpb.IndexEntry, error) {
+	encodedBlob, err := proto.Marshal(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal blob data: %w", err)
+	}
+	frame, err := e.buildBlobFrame(encodedBlob, blobTypeData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode data block: %w", err)
+	}
+
+	var stats *gosmpb.IndexEntry
+	if e.indexEnabled {
+		stats, err = computeBlockStats(block)
+		if err != nil {
+			return nil, nil, fmt.Errorf("compute block stats: %w", err)
+		}
+		stats.UncompressedSize = int32Pointer(int32(len(encodedBlob)))
+	}
+	return frame, stats, nil
+}
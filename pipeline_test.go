@@ -0,0 +1,87 @@
+// Copyright 2021 Grabtaxi Holdings Pte Ltd (GRAB), All rights reserved.
+
+// Use of this source code is governed by an MIT-style license that can be found in the LICENSE file
+
+package gosm
+
+import (
+	"testing"
+
+	"github.com/MichielMortier/gosm/gosmpb"
+)
+
+// discardWriteCloser is an io.WriteCloser that throws away everything
+// written to it, so the benchmarks below measure the compression pipeline
+// itself rather than I/O.
+type discardWriteCloser struct{}
+
+func (discardWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (discardWriteCloser) Close() error                { return nil }
+
+// benchPrimitiveBlocks builds n dense-node PrimitiveBlocks large enough that
+// compressing them dominates the pipeline's work, so BenchmarkCompression*
+// actually measures worker-pool scaling rather than channel overhead.
+func benchPrimitiveBlocks(n int) []*gosmpb.PrimitiveBlock {
+	blocks := make([]*gosmpb.PrimitiveBlock, n)
+	for i := range blocks {
+		dense := &gosmpb.DenseNodes{
+			Id:  make([]int64, defaultLimitNumberInOnePrimitiveGroup),
+			Lat: make([]int64, defaultLimitNumberInOnePrimitiveGroup),
+			Lon: make([]int64, defaultLimitNumberInOnePrimitiveGroup),
+		}
+		for j := range dense.Id {
+			dense.Id[j] = 1
+			dense.Lat[j] = 100
+			dense.Lon[j] = 100
+		}
+		blocks[i] = &gosmpb.PrimitiveBlock{
+			Primitivegroup: []*gosmpb.PrimitiveGroup{{Dense: dense}},
+		}
+	}
+	return blocks
+}
+
+// runCompressionBenchmark feeds the same blocks through startCompressionPipeline
+// directly, bypassing the node-buffering layer, so only the worker-pool/writer
+// machinery WithCompressionWorkers controls is under measurement.
+func runCompressionBenchmark(b *testing.B, workers int) {
+	blocks := benchPrimitiveBlocks(50)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		e := NewEncoder(&NewEncoderRequiredInput{Writer: discardWriteCloser{}}, WithCompressionWorkers(workers))
+		errs, err := e.Start()
+		if err != nil {
+			b.Fatalf("start encoder: %v", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for err := range errs {
+				b.Errorf("encode: %v", err)
+			}
+		}()
+
+		for seq, block := range blocks {
+			e.writeBuf <- &writeJob{seq: uint64(seq), block: block}
+		}
+		if err := e.Close(); err != nil {
+			b.Fatalf("close encoder: %v", err)
+		}
+		<-done
+	}
+}
+
+// BenchmarkCompressionWorkers1 is the sequential baseline (WithCompressionWorkers
+// defaults to 1), so its allocs/op and ns/op are the comparison point for the
+// parallel variants below.
+func BenchmarkCompressionWorkers1(b *testing.B) { runCompressionBenchmark(b, 1) }
+
+// BenchmarkCompressionWorkers4 demonstrates the worker pool scaling CPU-bound
+// compression across cores on multi-core hosts.
+func BenchmarkCompressionWorkers4(b *testing.B) { runCompressionBenchmark(b, 4) }
+
+// BenchmarkCompressionWorkers8 pushes the pool further to show scaling
+// continuing past a handful of workers on hosts with enough cores.
+func BenchmarkCompressionWorkers8(b *testing.B) { runCompressionBenchmark(b, 8) }
@@ -0,0 +1,255 @@
+// Copyright 2021 Grabtaxi Holdings Pte Ltd (GRAB), All rights reserved.
+
+// Use of this source code is governed by an MIT-style license that can be found in the LICENSE file
+
+package gosm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/MichielMortier/gosm/gosmpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// SeekBBox streams only the nodes/ways/relations held in blobs whose
+// recorded bbox overlaps bbox. It uses the index TOC written by an Encoder
+// created with WithIndex when the underlying reader supports io.Seeker, falling
+// back to a full Start()-style linear scan otherwise so non-indexed files,
+// or readers that can't seek, still work.
+func (d *Decoder) SeekBBox(bbox *gosmpb.HeaderBBox) (chan error, error) {
+	return d.seek(func(entry *gosmpb.IndexEntry) bool {
+		return bboxesOverlap(entry.GetBbox(), bbox)
+	})
+}
+
+// SeekIDRange streams only the blobs whose recorded ID range for memberType
+// overlaps [lo, hi]. memberType is one of NodeType, WayType or RelationType.
+func (d *Decoder) SeekIDRange(memberType MemberType, lo, hi int64) (chan error, error) {
+	return d.seek(func(entry *gosmpb.IndexEntry) bool {
+		switch memberType {
+		case NodeType:
+			return entry.MinNodeId != nil && rangesOverlap(entry.GetMinNodeId(), entry.GetMaxNodeId(), lo, hi)
+		case WayType:
+			return entry.MinWayId != nil && rangesOverlap(entry.GetMinWayId(), entry.GetMaxWayId(), lo, hi)
+		case RelationType:
+			return entry.MinRelationId != nil && rangesOverlap(entry.GetMinRelationId(), entry.GetMaxRelationId(), lo, hi)
+		default:
+			return false
+		}
+	})
+}
+
+// seek reads the file header, then streams the data blobs matching keep.
+// When the reader supports io.Seeker and a TOC trailer is present, only
+// matching blobs are read from their recorded offsets; otherwise it falls
+// back to linearScanFiltered, which still reads every blob in file order but
+// computes each one's stats on the fly and skips those keep rejects, so the
+// predicate is honored either way.
+func (d *Decoder) seek(keep func(*gosmpb.IndexEntry) bool) (chan error, error) {
+	rs, ok := d.reader.(io.ReadSeeker)
+	if !ok {
+		d.logger.Printf("%s: reader does not support Seek, falling back to a linear scan", logTag)
+		return d.linearScanFiltered(keep)
+	}
+
+	toc, err := d.loadIndex(rs)
+	if err != nil {
+		d.logger.Printf("%s: no usable index (%v), falling back to a linear scan", logTag, err)
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("rewind reader: %w", err)
+		}
+		return d.linearScanFiltered(keep)
+	}
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("rewind reader: %w", err)
+	}
+	if err := d.readAndValidateHeader(); err != nil {
+		return nil, err
+	}
+
+	go d.streamMatchingBlobs(rs, toc, keep)
+	return d.errs, nil
+}
+
+// readAndValidateHeader reads the first blob, which must be the file's
+// HeaderBlock, validates its required features and stores its bbox.
+func (d *Decoder) readAndValidateHeader() error {
+	blobType, blob, err := d.readBlob()
+	if err != nil {
+		return fmt.Errorf("read file header blob: %w", err)
+	}
+	if blobType != blobTypeHeader {
+		return fmt.Errorf("unexpected first blob type %q, want %q", blobType, blobTypeHeader)
+	}
+	payload, err := decompressBlob(blob)
+	if err != nil {
+		return fmt.Errorf("decompress file header blob: %w", err)
+	}
+	header := &gosmpb.HeaderBlock{}
+	if err := proto.Unmarshal(payload, header); err != nil {
+		return fmt.Errorf("unmarshal file header: %w", err)
+	}
+	if err := d.validateRequiredFeatures(header.RequiredFeatures); err != nil {
+		return err
+	}
+	d.bbox = header.Bbox
+	return nil
+}
+
+// linearScanFiltered is the seek() fallback used when no TOC is available or
+// the reader can't seek: it reads the header, then every remaining data blob
+// in file order, computing each one's stats to evaluate keep before
+// extracting and emitting its members.
+func (d *Decoder) linearScanFiltered(keep func(*gosmpb.IndexEntry) bool) (chan error, error) {
+	if err := d.readAndValidateHeader(); err != nil {
+		return nil, err
+	}
+	go d.streamFilteredBlobs(keep)
+	return d.errs, nil
+}
+
+func (d *Decoder) streamFilteredBlobs(keep func(*gosmpb.IndexEntry) bool) {
+	defer close(d.Nodes)
+	defer close(d.Ways)
+	defer close(d.Relations)
+	defer close(d.errs)
+
+	for {
+		blobType, blob, err := d.readBlob()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			d.errs <- fmt.Errorf("read blob: %w", err)
+			return
+		}
+		if blobType != blobTypeData {
+			continue
+		}
+		block, err := unmarshalDataBlob(blob)
+		if err != nil {
+			d.errs <- err
+			continue
+		}
+		stats, err := computeBlockStats(block)
+		if err != nil {
+			d.errs <- err
+			continue
+		}
+		if !keep(stats) {
+			continue
+		}
+		nodes, ways, relations, err := extractMembers(block)
+		if err != nil {
+			d.errs <- err
+			continue
+		}
+		if len(nodes) > 0 {
+			d.Nodes <- nodes
+		}
+		if len(ways) > 0 {
+			d.Ways <- ways
+		}
+		if len(relations) > 0 {
+			d.Relations <- relations
+		}
+	}
+}
+
+func (d *Decoder) streamMatchingBlobs(rs io.ReadSeeker, toc *gosmpb.OSMIndex, keep func(*gosmpb.IndexEntry) bool) {
+	defer close(d.Nodes)
+	defer close(d.Ways)
+	defer close(d.Relations)
+	defer close(d.errs)
+
+	for _, entry := range toc.Entries {
+		if !keep(entry) {
+			continue
+		}
+		if _, err := rs.Seek(entry.GetOffset(), io.SeekStart); err != nil {
+			d.errs <- fmt.Errorf("seek to blob at offset %d: %w", entry.GetOffset(), err)
+			continue
+		}
+		blobType, blob, err := d.readBlob()
+		if err != nil {
+			d.errs <- fmt.Errorf("read blob at offset %d: %w", entry.GetOffset(), err)
+			continue
+		}
+		if blobType != blobTypeData {
+			continue
+		}
+		nodes, ways, relations, err := d.decodeDataBlob(blob)
+		if err != nil {
+			d.errs <- err
+			continue
+		}
+		if len(nodes) > 0 {
+			d.Nodes <- nodes
+		}
+		if len(ways) > 0 {
+			d.Ways <- ways
+		}
+		if len(relations) > 0 {
+			d.Relations <- relations
+		}
+	}
+}
+
+// loadIndex reads the fixed-size "OSMIndexTrailer" blob at the end of the
+// file and uses it to locate and parse the OSMIndex blob a WithIndex-enabled
+// Encoder appended.
+func (d *Decoder) loadIndex(rs io.ReadSeeker) (*gosmpb.OSMIndex, error) {
+	if _, err := rs.Seek(-int64(indexTrailerFrameSize), io.SeekEnd); err != nil {
+		return nil, fmt.Errorf("seek to trailer: %w", err)
+	}
+	blobType, blob, err := d.readBlob()
+	if err != nil {
+		return nil, fmt.Errorf("read trailer: %w", err)
+	}
+	if blobType != blobTypeIndexTrailer {
+		return nil, fmt.Errorf("blob at trailer offset is %q, want %q", blobType, blobTypeIndexTrailer)
+	}
+	trailer, err := decompressBlob(blob)
+	if err != nil {
+		return nil, fmt.Errorf("decompress trailer: %w", err)
+	}
+	if len(trailer) != indexTrailerSize {
+		return nil, fmt.Errorf("trailer payload is %d bytes, want %d", len(trailer), indexTrailerSize)
+	}
+	indexOffset := binary.BigEndian.Uint64(trailer[:8])
+
+	if _, err := rs.Seek(int64(indexOffset), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek to index blob: %w", err)
+	}
+	blobType, blob, err = d.readBlob()
+	if err != nil {
+		return nil, fmt.Errorf("read index blob: %w", err)
+	}
+	if blobType != blobTypeIndex {
+		return nil, fmt.Errorf("blob at trailer offset is %q, want %q", blobType, blobTypeIndex)
+	}
+	payload, err := decompressBlob(blob)
+	if err != nil {
+		return nil, fmt.Errorf("decompress index blob: %w", err)
+	}
+	index := &gosmpb.OSMIndex{}
+	if err := proto.Unmarshal(payload, index); err != nil {
+		return nil, fmt.Errorf("unmarshal index: %w", err)
+	}
+	return index, nil
+}
+
+func bboxesOverlap(a, b *gosmpb.HeaderBBox) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.GetLeft() <= b.GetRight() && a.GetRight() >= b.GetLeft() &&
+		a.GetBottom() <= b.GetTop() && a.GetTop() >= b.GetBottom()
+}
+
+func rangesOverlap(entryLo, entryHi, lo, hi int64) bool {
+	return entryLo <= hi && entryHi >= lo
+}